@@ -0,0 +1,343 @@
+package opentsdb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	backoffBase = 200 * time.Millisecond
+	backoffMax  = 30 * time.Second
+)
+
+// AsyncClient batches metrics like Client but hands batches off to a pool
+// of background workers instead of blocking the caller. Batches that can't
+// be delivered after maxRetries retries, or that arrive while the queue is
+// full, are spilled to the handoff directory (if configured) and replayed
+// on the next NewAsyncClient startup.
+type AsyncClient struct {
+	client     *Client
+	batchSize  int
+	maxRetries int
+	handoffDir string
+
+	mu     sync.Mutex
+	buffer []Metric
+
+	queue chan []Metric
+	wg    sync.WaitGroup
+
+	closeOnce sync.Once
+
+	handoffMu   sync.Mutex
+	handoffFile *os.File
+
+	queuedBatches int64
+	inFlight      int64
+	outstanding   int64 // dispatched-but-not-yet-delivered batches; see Flush
+	dropped       int64
+	retried       int64
+	bytesSent     int64
+}
+
+// Stats is a point-in-time snapshot of an AsyncClient's activity.
+type Stats struct {
+	Queued    int64
+	InFlight  int64
+	Dropped   int64
+	Retried   int64
+	BytesSent int64
+}
+
+// NewAsyncClient builds an AsyncClient backed by the same transport options
+// as NewClient (WithAuth, WithGzip, WithHTTPClient, ...), plus
+// WithAsyncWorkers, WithQueueSize, WithHandoffDir and WithMaxRetries to tune
+// the background delivery pipeline. If a handoff directory was configured
+// and already holds spilled batches from a previous run, they're replayed
+// before NewAsyncClient returns.
+func NewAsyncClient(url string, options ...Option) (*AsyncClient, error) {
+	client, err := NewClient(url, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &config{
+		batchSize:    defaultBatchSize,
+		asyncWorkers: defaultAsyncWorkers,
+		queueSize:    defaultQueueSize,
+		maxRetries:   defaultMaxRetries,
+	}
+	for _, o := range options {
+		if err := o(cfg); err != nil {
+			return nil, fmt.Errorf("failed to construc opentsdb client: %w", err)
+		}
+	}
+
+	ac := &AsyncClient{
+		client:     client,
+		batchSize:  cfg.batchSize,
+		maxRetries: cfg.maxRetries,
+		handoffDir: cfg.handoffDir,
+		queue:      make(chan []Metric, cfg.queueSize),
+	}
+
+	// Workers must be running before we replay handoff segments below: a
+	// segment can hold more batches than the queue is sized for, and
+	// replaySegment dispatches through the same bounded queue the workers
+	// drain.
+	for i := 0; i < cfg.asyncWorkers; i++ {
+		ac.wg.Add(1)
+		go ac.worker()
+	}
+
+	if ac.handoffDir != "" {
+		if err := os.MkdirAll(ac.handoffDir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create handoff dir: %w", err)
+		}
+		if err := ac.replayHandoff(); err != nil {
+			return nil, fmt.Errorf("failed to replay handoff: %w", err)
+		}
+		f, err := os.OpenFile(filepath.Join(ac.handoffDir, fmt.Sprintf("handoff-%d.jsonl", time.Now().UnixNano())), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open handoff segment: %w", err)
+		}
+		ac.handoffFile = f
+	}
+
+	return ac, nil
+}
+
+// Enqueue buffers metric and, once batchSize is reached, hands the batch off
+// to the background workers. It never blocks on the network.
+func (ac *AsyncClient) Enqueue(metric Metric) error {
+	if metric.Tags == nil {
+		return errors.New("tags can not be nil")
+	}
+
+	ac.mu.Lock()
+	ac.buffer = append(ac.buffer, metric)
+	var batch []Metric
+	if len(ac.buffer) >= ac.batchSize {
+		batch = ac.buffer
+		ac.buffer = nil
+	}
+	ac.mu.Unlock()
+
+	if batch != nil {
+		ac.dispatch(batch)
+	}
+	return nil
+}
+
+// dispatch hands a batch to a free worker, or spills it to hinted handoff
+// if the queue is saturated.
+func (ac *AsyncClient) dispatch(batch []Metric) {
+	select {
+	case ac.queue <- batch:
+		atomic.AddInt64(&ac.queuedBatches, 1)
+		atomic.AddInt64(&ac.outstanding, 1)
+	default:
+		ac.spill(batch)
+	}
+}
+
+func (ac *AsyncClient) worker() {
+	defer ac.wg.Done()
+	for batch := range ac.queue {
+		atomic.AddInt64(&ac.queuedBatches, -1)
+		atomic.AddInt64(&ac.inFlight, 1)
+		ac.deliver(batch)
+		atomic.AddInt64(&ac.inFlight, -1)
+		atomic.AddInt64(&ac.outstanding, -1)
+	}
+}
+
+// deliver sends batch, retrying retryable errors with exponential backoff
+// and jitter. Fatal errors (4xx) are dropped rather than retried; batches
+// that exhaust maxRetries are spilled to hinted handoff instead of being
+// lost. A *PartialWriteError means OpenTSDB already accepted the good
+// datapoints in the batch, so it's counted and dropped rather than retried
+// wholesale.
+func (ac *AsyncClient) deliver(batch []Metric) {
+	for attempt := 0; ; attempt++ {
+		n, resp, err := ac.client.send(batch)
+		if err == nil {
+			atomic.AddInt64(&ac.bytesSent, int64(n))
+			return
+		}
+
+		var partialErr *PartialWriteError
+		if errors.As(err, &partialErr) {
+			atomic.AddInt64(&ac.bytesSent, int64(n))
+			atomic.AddInt64(&ac.dropped, int64(resp.Failed))
+			return
+		}
+
+		if !isRetryable(err) {
+			atomic.AddInt64(&ac.dropped, 1)
+			return
+		}
+
+		if attempt >= ac.maxRetries {
+			ac.spill(batch)
+			return
+		}
+
+		atomic.AddInt64(&ac.retried, 1)
+		time.Sleep(backoff(attempt))
+	}
+}
+
+// isRetryable classifies send errors the way Telegraf's InfluxDB output
+// does: a rejected 4xx response is a fatal, non-retryable write (the batch
+// will never succeed as-is), while network errors and 5xx responses are
+// presumed transient.
+func isRetryable(err error) bool {
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) {
+		return true
+	}
+	return statusErr.StatusCode >= 500
+}
+
+func backoff(attempt int) time.Duration {
+	d := backoffBase * time.Duration(1<<uint(attempt))
+	if d > backoffMax || d <= 0 {
+		d = backoffMax
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// spill appends batch to the active handoff segment file. If no handoff
+// directory is configured the batch is dropped.
+func (ac *AsyncClient) spill(batch []Metric) {
+	if ac.handoffFile == nil {
+		atomic.AddInt64(&ac.dropped, 1)
+		return
+	}
+
+	b, err := json.Marshal(batch)
+	if err != nil {
+		atomic.AddInt64(&ac.dropped, 1)
+		return
+	}
+
+	ac.handoffMu.Lock()
+	defer ac.handoffMu.Unlock()
+	if _, err := ac.handoffFile.Write(append(b, '\n')); err != nil {
+		atomic.AddInt64(&ac.dropped, 1)
+	}
+}
+
+// replayHandoff reads every segment file left over from a previous run,
+// re-queues its batches and removes the file once fully consumed.
+func (ac *AsyncClient) replayHandoff() error {
+	entries, err := os.ReadDir(ac.handoffDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".jsonl" {
+			continue
+		}
+		path := filepath.Join(ac.handoffDir, entry.Name())
+		if err := ac.replaySegment(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ac *AsyncClient) replaySegment(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var batch []Metric
+		if err := json.Unmarshal(scanner.Bytes(), &batch); err != nil {
+			continue
+		}
+		// dispatch rather than a raw channel send: a segment can hold more
+		// batches than the queue is sized for, and dispatch falls back to
+		// re-spilling instead of blocking forever on a full queue.
+		ac.dispatch(batch)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// Flush blocks until any buffered metrics have been handed off and every
+// batch currently queued or in flight has been delivered (or spilled to
+// handoff), or ctx is done.
+func (ac *AsyncClient) Flush(ctx context.Context) error {
+	ac.mu.Lock()
+	batch := ac.buffer
+	ac.buffer = nil
+	ac.mu.Unlock()
+	if len(batch) > 0 {
+		ac.dispatch(batch)
+	}
+
+	for {
+		// outstanding, not queuedBatches+inFlight, is what's safe to check
+		// here: a worker decrements queuedBatches and increments inFlight as
+		// two separate atomic ops, so there's a window where both read zero
+		// for a batch that hasn't actually been delivered yet. outstanding
+		// only drops once deliver has returned.
+		if atomic.LoadInt64(&ac.outstanding) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Stats returns a snapshot of the client's current activity.
+func (ac *AsyncClient) Stats() Stats {
+	return Stats{
+		Queued:    atomic.LoadInt64(&ac.queuedBatches),
+		InFlight:  atomic.LoadInt64(&ac.inFlight),
+		Dropped:   atomic.LoadInt64(&ac.dropped),
+		Retried:   atomic.LoadInt64(&ac.retried),
+		BytesSent: atomic.LoadInt64(&ac.bytesSent),
+	}
+}
+
+// Close flushes any buffered metrics, stops accepting new work and waits
+// for the worker pool to drain.
+func (ac *AsyncClient) Close() error {
+	err := ac.Flush(context.Background())
+
+	ac.closeOnce.Do(func() {
+		close(ac.queue)
+	})
+	ac.wg.Wait()
+
+	if ac.handoffFile != nil {
+		ac.handoffMu.Lock()
+		ac.handoffFile.Close()
+		ac.handoffMu.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,125 @@
+package opentsdb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAsyncClient_ConcurrentEnqueueClose(t *testing.T) {
+	var received int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []Metric
+		_ = json.NewDecoder(r.Body).Decode(&batch)
+		atomic.AddInt64(&received, int64(len(batch)))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	const goroutines = 20
+	const perGoroutine = 50
+
+	client, err := NewAsyncClient(srv.URL, WithBatchSize(5), WithAsyncWorkers(4), WithQueueSize(goroutines*perGoroutine))
+	if err != nil {
+		t.Fatalf("NewAsyncClient: %v", err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perGoroutine; j++ {
+				if err := client.Enqueue(Metric{Metric: "test", Value: 1, Tags: map[string]string{"h": "a"}}); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if want := int64(goroutines * perGoroutine); atomic.LoadInt64(&received) != want {
+		t.Fatalf("server received %d metrics, want %d", received, want)
+	}
+}
+
+// TestAsyncClient_HandoffReplayLargerThanQueue reproduces the deadlock this
+// test guards against: a handoff segment holding more batches than the
+// configured queue size must still be fully replayed, because workers are
+// started before replay runs and dispatch falls back to re-spilling rather
+// than blocking on a full queue.
+func TestAsyncClient_HandoffReplayLargerThanQueue(t *testing.T) {
+	var received int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&received, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	const queueSize = 2
+	const batches = 10
+	f, err := os.OpenFile(filepath.Join(dir, "handoff-1.jsonl"), os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("open segment: %v", err)
+	}
+	for i := 0; i < batches; i++ {
+		batch := []Metric{{Metric: "test", Value: i, Tags: map[string]string{"h": "a"}}}
+		b, err := json.Marshal(batch)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		if _, err := f.Write(append(b, '\n')); err != nil {
+			t.Fatalf("write segment: %v", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("close segment: %v", err)
+	}
+
+	done := make(chan error, 1)
+	var client *AsyncClient
+	go func() {
+		var err error
+		client, err = NewAsyncClient(srv.URL, WithHandoffDir(dir), WithQueueSize(queueSize), WithAsyncWorkers(2))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("NewAsyncClient: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("NewAsyncClient deadlocked replaying a handoff segment larger than the queue")
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		if atomic.LoadInt64(&received)+client.Stats().Dropped >= batches {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("only delivered/dropped %d of %d replayed batches", atomic.LoadInt64(&received)+client.Stats().Dropped, batches)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
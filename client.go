@@ -2,25 +2,129 @@ package opentsdb
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"sync"
+	"time"
 )
 
 const defaultBatchSize = 20
 
+const (
+	defaultAsyncWorkers = 4
+	defaultQueueSize    = 64
+	defaultMaxRetries   = 5
+)
+
+const defaultEndpointPath = "/api/put"
+
 // Client has 2 options to send metrics:
 // - Enqueue metrics, send when batchSize collected and flush buffer. Use Push to force send current buffer.
 // - Send single Metric immediately.
 type Client struct {
-	url       string
-	authUser  string
-	authPass  string
-	buffer    []Metric
-	batchSize int
+	url            string
+	authUser       string
+	authPass       string
+	batchSize      int
+	httpClient     *http.Client
+	gzip           bool
+	requestTimeout time.Duration
+	putMode        PutMode
+	telnet         *telnetTransport
+	serializer     Serializer
+	endpointPath   string
+
+	mu     sync.Mutex
+	buffer []Metric
+	closed bool
+}
+
+// PutMode selects which /api/put query parameter the client requests,
+// trading response detail for the overhead of OpenTSDB building that
+// response.
+type PutMode int
+
+const (
+	// PutModeSync is the default: OpenTSDB responds with an empty body on
+	// success and the raw error body on failure.
+	PutModeSync PutMode = iota
+	// PutModeSummary requests ?summary: the response body is a PutResponse
+	// with Failed/Success counts but no per-point Errors.
+	PutModeSummary
+	// PutModeDetails requests ?details: the response body is a PutResponse
+	// including Errors for every rejected datapoint.
+	PutModeDetails
+)
+
+// PutResponse is OpenTSDB's JSON body for /api/put?summary and
+// /api/put?details requests.
+type PutResponse struct {
+	Failed  int          `json:"failed"`
+	Success int          `json:"success"`
+	Errors  []PointError `json:"errors,omitempty"`
+}
+
+// PointError describes one datapoint OpenTSDB rejected, as returned by
+// /api/put?details.
+type PointError struct {
+	Datapoint Metric `json:"datapoint"`
+	Error     string `json:"error"`
+}
+
+// PartialWriteError is returned when OpenTSDB accepted some datapoints in a
+// batch and rejected others. Response.Errors (populated in PutModeDetails)
+// identifies which ones, so callers can inspect or re-send just the
+// rejected metrics instead of retrying the whole batch.
+type PartialWriteError struct {
+	Response *PutResponse
+}
+
+func (e *PartialWriteError) Error() string {
+	return fmt.Sprintf("opentsdb: partial write: %d succeeded, %d failed", e.Response.Success, e.Response.Failed)
+}
+
+// Serializer turns a batch of metrics into a request body and the
+// Content-Type to send it with. It lets alternative wire formats (e.g.
+// OTLP) plug into the existing batching, gzip and retry machinery without
+// forking the client.
+type Serializer interface {
+	Serialize(metrics []Metric) (body []byte, contentType string, err error)
+}
+
+// JSONSerializer is the default Serializer, matching OpenTSDB's /api/put
+// body format.
+type JSONSerializer struct{}
+
+func (JSONSerializer) Serialize(metrics []Metric) ([]byte, string, error) {
+	b, err := json.Marshal(metrics)
+	return b, "application/json", err
+}
+
+// streamingSerializer lets a Serializer write its body straight into the
+// request's gzip.Writer instead of going through an intermediate []byte.
+// JSONSerializer implements it so the streaming json.Encoder behavior from
+// the original gzip support is preserved even though Serializer itself is
+// byte-slice based for serializers (like OTLPSerializer) that must compute
+// the whole payload before they can encode it.
+type streamingSerializer interface {
+	SerializeTo(w io.Writer, metrics []Metric) (contentType string, err error)
+}
+
+func (JSONSerializer) SerializeTo(w io.Writer, metrics []Metric) (string, error) {
+	return "application/json", json.NewEncoder(w).Encode(metrics)
+}
+
+// methodSerializer lets a Serializer override the default HTTP method
+// (PUT, matching OpenTSDB's /api/put) when its target endpoint expects
+// something else, e.g. OTLP/HTTP's POST-only /v1/metrics.
+type methodSerializer interface {
+	Method() string
 }
 
 type Metric struct {
@@ -31,9 +135,20 @@ type Metric struct {
 }
 
 type config struct {
-	authUsername string
-	authPassword string
-	batchSize    int
+	authUsername   string
+	authPassword   string
+	batchSize      int
+	httpClient     *http.Client
+	gzip           bool
+	requestTimeout time.Duration
+	asyncWorkers   int
+	queueSize      int
+	handoffDir     string
+	maxRetries     int
+	putMode        PutMode
+	telnetAddr     string
+	serializer     Serializer
+	endpointPath   string
 }
 
 func NewClient(url string, options ...Option) (*Client, error) {
@@ -41,6 +156,12 @@ func NewClient(url string, options ...Option) (*Client, error) {
 		authUsername: "",
 		authPassword: "",
 		batchSize:    defaultBatchSize,
+		httpClient:   http.DefaultClient,
+		asyncWorkers: defaultAsyncWorkers,
+		queueSize:    defaultQueueSize,
+		maxRetries:   defaultMaxRetries,
+		serializer:   JSONSerializer{},
+		endpointPath: defaultEndpointPath,
 	}
 	for _, o := range options {
 		err := o(config)
@@ -49,12 +170,22 @@ func NewClient(url string, options ...Option) (*Client, error) {
 		}
 	}
 
-	return &Client{
-		url:       url,
-		authUser:  config.authUsername,
-		authPass:  config.authPassword,
-		batchSize: config.batchSize,
-	}, nil
+	client := &Client{
+		url:            url,
+		authUser:       config.authUsername,
+		authPass:       config.authPassword,
+		batchSize:      config.batchSize,
+		httpClient:     config.httpClient,
+		gzip:           config.gzip,
+		requestTimeout: config.requestTimeout,
+		putMode:        config.putMode,
+		serializer:     config.serializer,
+		endpointPath:   config.endpointPath,
+	}
+	if config.telnetAddr != "" {
+		client.telnet = newTelnetTransport(config.telnetAddr)
+	}
+	return client, nil
 }
 
 // Enqueue send metric to a buffer. Metrics are sent when buffer reaches batchSize number.
@@ -62,75 +193,199 @@ func (c *Client) Enqueue(metric Metric) error {
 	if metric.Tags == nil {
 		return errors.New("tags can not be nil")
 	}
+
+	c.mu.Lock()
 	c.buffer = append(c.buffer, metric)
+	var batch []Metric
 	if len(c.buffer) >= c.batchSize {
-		err := c.send(c.buffer)
-		c.buffer = []Metric{}
-		if err != nil {
-			return err
-		}
+		batch = c.buffer
+		c.buffer = nil
+	}
+	c.mu.Unlock()
+
+	if batch != nil {
+		_, _, err := c.send(batch)
+		return err
 	}
 	return nil
 }
 
-// Send single Metric immediately
-func (c *Client) Send(metric Metric) error {
+// Send single Metric immediately. The returned *PutResponse is only
+// populated when the client was built with WithPutMode(Summary) or
+// WithPutMode(Details).
+func (c *Client) Send(metric Metric) (*PutResponse, error) {
 	if metric.Tags == nil {
-		return errors.New("tags can not be nil")
+		return nil, errors.New("tags can not be nil")
 	}
-	return c.send([]Metric{metric})
+	_, resp, err := c.send([]Metric{metric})
+	return resp, err
 }
 
-func (c *Client) send(metric []Metric) error {
-	url := fmt.Sprintf("%s/api/put", c.url)
-	m, err := json.Marshal(metric)
+// send serializes metrics with c.serializer, optionally gzip-compresses the
+// result, and sends it to c.endpointPath with PUT (or the serializer's
+// Method, if it implements methodSerializer). It returns the number of bytes
+// written on the wire (used by AsyncClient for stats reporting) and, when
+// using JSONSerializer with PutModeSummary/PutModeDetails, the decoded
+// PutResponse.
+func (c *Client) send(metric []Metric) (int, *PutResponse, error) {
+	if c.telnet != nil {
+		n, err := c.telnet.send(metric)
+		return n, nil, err
+	}
+
+	url := fmt.Sprintf("%s%s", c.url, c.endpointPath)
+	_, jsonSerializer := c.serializer.(JSONSerializer)
+	if jsonSerializer {
+		switch c.putMode {
+		case PutModeSummary:
+			url += "?summary"
+		case PutModeDetails:
+			url += "?details"
+		}
+	}
+
+	var buf bytes.Buffer
+	var contentType, contentEncoding string
+	var err error
+	w := io.Writer(&buf)
+	var gw *gzip.Writer
+	if c.gzip {
+		gw = gzip.NewWriter(&buf)
+		w = gw
+		contentEncoding = "gzip"
+	}
+
+	if sw, ok := c.serializer.(streamingSerializer); ok {
+		// Write straight into w (the gzip.Writer when gzip is enabled)
+		// instead of building an intermediate []byte with Serialize, the
+		// same streaming trick the original gzip support used.
+		contentType, err = sw.SerializeTo(w, metric)
+	} else {
+		var body []byte
+		body, contentType, err = c.serializer.Serialize(metric)
+		if err == nil {
+			_, err = w.Write(body)
+		}
+	}
 	if err != nil {
-		return err
+		return 0, nil, err
 	}
-	req, err := http.NewRequest(http.MethodPut, url, body(m))
+	if gw != nil {
+		if err := gw.Close(); err != nil {
+			return 0, nil, err
+		}
+	}
+	bytesSent := buf.Len()
+
+	ctx := context.Background()
+	if c.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.requestTimeout)
+		defer cancel()
+	}
+
+	method := http.MethodPut
+	if ms, ok := c.serializer.(methodSerializer); ok {
+		method = ms.Method()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, &buf)
 	if err != nil {
-		return err
+		return 0, nil, err
 	}
 
 	if c.authUser != "" {
 		req.SetBasicAuth(c.authUser, c.authPass)
 	}
-	req.Header.Add("Content-Type", "application/json")
-	res, err := http.DefaultClient.Do(req)
+	req.Header.Add("Content-Type", contentType)
+	if contentEncoding != "" {
+		req.Header.Add("Content-Encoding", contentEncoding)
+	}
+	res, err := c.httpClient.Do(req)
 	if err != nil {
-		return err
+		return 0, nil, err
 	}
-	if res.StatusCode >= 400 {
-		b, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			return err
+	defer res.Body.Close()
+
+	if !jsonSerializer || c.putMode == PutModeSync {
+		if res.StatusCode >= 400 {
+			b, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				return 0, nil, err
+			}
+			return 0, nil, &HTTPStatusError{StatusCode: res.StatusCode, Status: res.Status, Body: string(b)}
 		}
-		return fmt.Errorf("%s: %s", res.Status, string(b))
+		return bytesSent, nil, nil
 	}
 
-	return nil
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	var putResp PutResponse
+	if len(b) > 0 {
+		if jsonErr := json.Unmarshal(b, &putResp); jsonErr != nil {
+			if res.StatusCode >= 400 {
+				return 0, nil, &HTTPStatusError{StatusCode: res.StatusCode, Status: res.Status, Body: string(b)}
+			}
+			return 0, nil, jsonErr
+		}
+	}
+	if putResp.Failed > 0 {
+		return bytesSent, &putResp, &PartialWriteError{Response: &putResp}
+	}
+	return bytesSent, &putResp, nil
 }
 
-// Push buffer and clean it
-func (c *Client) Push() error {
-	if len(c.buffer) == 0 {
-		return nil
-	}
-	err := c.send(c.buffer)
-	c.buffer = []Metric{}
-	if err != nil {
-		return err
+// HTTPStatusError is returned by send when OpenTSDB responds with a status
+// >= 400. Its StatusCode lets callers (notably the async worker's retry
+// logic) tell a transient server error from a permanently rejected batch.
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Status, e.Body)
+}
+
+// Push buffer and clean it. The returned *PutResponse is only populated
+// when the client was built with WithPutMode(Summary) or
+// WithPutMode(Details).
+func (c *Client) Push() (*PutResponse, error) {
+	c.mu.Lock()
+	batch := c.buffer
+	c.buffer = nil
+	c.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil, nil
 	}
-	return nil
+	_, resp, err := c.send(batch)
+	return resp, err
 }
 
-// Close should be used on service down to prevent an unfilled buffer to be gone
+// Close flushes any buffered metrics and, if the client was built with
+// WithTelnetTransport, closes the underlying connection. It is safe to
+// call more than once.
 func (c *Client) Close() error {
-	return c.send(c.buffer)
-}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	batch := c.buffer
+	c.buffer = nil
+	c.mu.Unlock()
 
-func body(buf []byte) io.Reader {
-	return bytes.NewBuffer(buf)
+	_, _, err := c.send(batch)
+	if c.telnet != nil {
+		if closeErr := c.telnet.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
 }
 
 type Option func(*config) error
@@ -154,3 +409,148 @@ func WithBatchSize(n int) Option {
 		return nil
 	}
 }
+
+// WithGzip enables gzip compression of the request body, sent with a
+// Content-Encoding: gzip header. Useful for the typical 20-1024 metric
+// batches where JSON payloads compress well.
+func WithGzip(enabled bool) Option {
+	return func(c *config) error {
+		c.gzip = enabled
+		return nil
+	}
+}
+
+// WithHTTPClient overrides the default http.Client used for requests,
+// letting callers share a client tuned with keepalives, TLS settings or
+// custom transports across multiple opentsdb clients.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *config) error {
+		if client == nil {
+			return errors.New("http client can not be nil")
+		}
+		c.httpClient = client
+		return nil
+	}
+}
+
+// WithRequestTimeout bounds each PUT to /api/put with a context.WithTimeout
+// deadline of d.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(c *config) error {
+		if d < 0 {
+			return errors.New("request timeout can not be negative")
+		}
+		c.requestTimeout = d
+		return nil
+	}
+}
+
+// WithPutMode selects the /api/put query parameter the client requests.
+// PutModeSummary and PutModeDetails make OpenTSDB report how many datapoints
+// in a batch failed (and, with PutModeDetails, which ones), surfaced as a
+// *PartialWriteError.
+func WithPutMode(mode PutMode) Option {
+	return func(c *config) error {
+		if mode < PutModeSync || mode > PutModeDetails {
+			return errors.New("unknown put mode")
+		}
+		c.putMode = mode
+		return nil
+	}
+}
+
+// WithTelnetTransport switches the client from the HTTP /api/put transport
+// to OpenTSDB's telnet line protocol, writing `put <metric> <ts> <value>
+// tagk=tagv ...` over a persistent TCP connection to addr. The connection
+// is dialed lazily on the first send and automatically redialed if it
+// drops. WithGzip, WithPutMode and WithHTTPClient have no effect on a
+// telnet-transport client.
+func WithTelnetTransport(addr string) Option {
+	return func(c *config) error {
+		if addr == "" {
+			return errors.New("telnet addr can not be empty")
+		}
+		c.telnetAddr = addr
+		return nil
+	}
+}
+
+// WithSerializer overrides the default JSONSerializer used to turn metrics
+// into a request body, letting alternative wire formats (e.g. OTLP via
+// OTLPSerializer) reuse the same batching, gzip and retry machinery.
+func WithSerializer(s Serializer) Option {
+	return func(c *config) error {
+		if s == nil {
+			return errors.New("serializer can not be nil")
+		}
+		c.serializer = s
+		return nil
+	}
+}
+
+// WithEndpointPath overrides the path metrics are POSTed/PUT to, which
+// defaults to /api/put. Pair with WithSerializer when targeting a
+// collector that expects a different path, e.g. "/v1/metrics" for OTLP.
+func WithEndpointPath(p string) Option {
+	return func(c *config) error {
+		if p == "" {
+			return errors.New("endpoint path can not be empty")
+		}
+		c.endpointPath = p
+		return nil
+	}
+}
+
+// WithAsyncWorkers sets the number of goroutines an AsyncClient spawns to
+// drain its queue. Only meaningful for NewAsyncClient.
+func WithAsyncWorkers(n int) Option {
+	return func(c *config) error {
+		if n < 1 {
+			return errors.New("async workers should be at least 1")
+		}
+		c.asyncWorkers = n
+		return nil
+	}
+}
+
+// WithQueueSize sets the number of batches an AsyncClient will hold in
+// memory before spilling new ones to the hinted-handoff directory. Only
+// meaningful for NewAsyncClient.
+func WithQueueSize(n int) Option {
+	return func(c *config) error {
+		if n < 1 {
+			return errors.New("queue size should be at least 1")
+		}
+		c.queueSize = n
+		return nil
+	}
+}
+
+// WithHandoffDir enables hinted handoff: batches that can't be delivered
+// after WithMaxRetries retries, or that arrive while the queue is full,
+// are appended to segment files under dir and replayed on the next
+// NewAsyncClient startup. Segments are not replayed while a client is
+// running, including after a successful send. Only meaningful for
+// NewAsyncClient.
+func WithHandoffDir(dir string) Option {
+	return func(c *config) error {
+		if dir == "" {
+			return errors.New("handoff dir can not be empty")
+		}
+		c.handoffDir = dir
+		return nil
+	}
+}
+
+// WithMaxRetries caps the number of retryable-error retries an AsyncClient
+// attempts before spilling a batch to hinted handoff. Only meaningful for
+// NewAsyncClient.
+func WithMaxRetries(n int) Option {
+	return func(c *config) error {
+		if n < 0 {
+			return errors.New("max retries can not be negative")
+		}
+		c.maxRetries = n
+		return nil
+	}
+}
@@ -0,0 +1,38 @@
+// Command prom2opentsdb runs an HTTP server accepting Prometheus
+// remote_write requests and forwards every sample to an OpenTSDB server.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/n10ty/opentsdb-go-push"
+	"github.com/n10ty/opentsdb-go-push/remotewrite"
+)
+
+func main() {
+	listenAddr := flag.String("listen-addr", ":9201", "address to listen for Prometheus remote_write requests")
+	opentsdbURL := flag.String("opentsdb-url", "http://localhost:4242", "OpenTSDB base URL")
+	asyncWorkers := flag.Int("async-workers", 4, "number of background workers pushing to OpenTSDB")
+	flag.Parse()
+
+	client, err := opentsdb.NewAsyncClient(
+		*opentsdbURL,
+		opentsdb.WithGzip(true),
+		opentsdb.WithAsyncWorkers(*asyncWorkers),
+		opentsdb.WithRequestTimeout(10*time.Second),
+	)
+	if err != nil {
+		log.Fatalf("failed to create opentsdb client: %v", err)
+	}
+	defer client.Close()
+
+	handler := remotewrite.NewHandler(client, nil)
+
+	log.Printf("listening on %s, forwarding to %s", *listenAddr, *opentsdbURL)
+	if err := http.ListenAndServe(*listenAddr, handler); err != nil {
+		log.Fatal(err)
+	}
+}
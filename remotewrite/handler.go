@@ -0,0 +1,111 @@
+// Package remotewrite adapts Prometheus' remote_write protocol into pushes
+// against an OpenTSDB opentsdb.Client, so a Prometheus server can fan out
+// samples to OpenTSDB without a custom bridge.
+package remotewrite
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/n10ty/opentsdb-go-push"
+)
+
+// Sink is the subset of *opentsdb.Client / *opentsdb.AsyncClient the
+// Handler needs. Both satisfy it, so callers can back the handler with the
+// async variant to absorb Prometheus' write bursts.
+type Sink interface {
+	Enqueue(metric opentsdb.Metric) error
+}
+
+// Sanitizer rewrites a Prometheus label value into one OpenTSDB will
+// accept. The default Sanitizer strips every character outside
+// a-zA-Z0-9-_./, which is the full set OpenTSDB allows in tag values.
+type Sanitizer func(string) string
+
+var disallowedTagChars = regexp.MustCompile(`[^a-zA-Z0-9\-_./]`)
+
+// DefaultSanitizer strips characters OpenTSDB rejects in tag keys/values.
+func DefaultSanitizer(s string) string {
+	return disallowedTagChars.ReplaceAllString(s, "")
+}
+
+// Handler is an http.Handler that decodes Prometheus remote_write requests
+// and pushes each sample to a Sink.
+type Handler struct {
+	Sink      Sink
+	Sanitizer Sanitizer
+}
+
+// NewHandler builds a Handler backed by sink. If sanitizer is nil,
+// DefaultSanitizer is used.
+func NewHandler(sink Sink, sanitizer Sanitizer) *Handler {
+	if sanitizer == nil {
+		sanitizer = DefaultSanitizer
+	}
+	return &Handler{Sink: sink, Sanitizer: sanitizer}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	compressed, err := ioutil.ReadAll(io.LimitReader(r.Body, 64<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req prompb.WriteRequest
+	if err := req.Unmarshal(data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, ts := range req.Timeseries {
+		metricName, tags := h.labelsToMetric(ts.Labels)
+		if metricName == "" {
+			continue
+		}
+		for _, sample := range ts.Samples {
+			err := h.Sink.Enqueue(opentsdb.Metric{
+				Timestamp: sample.Timestamp,
+				Metric:    metricName,
+				Value:     sample.Value,
+				Tags:      tags,
+			})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// labelsToMetric splits Prometheus labels into an OpenTSDB metric name
+// (the __name__ label) and tag map, sanitizing every tag key/value.
+func (h *Handler) labelsToMetric(labels []prompb.Label) (string, map[string]string) {
+	metricName := ""
+	tags := make(map[string]string, len(labels))
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			metricName = h.Sanitizer(l.Value)
+			continue
+		}
+		tags[h.Sanitizer(l.Name)] = h.Sanitizer(l.Value)
+	}
+	if len(tags) == 0 {
+		// OpenTSDB requires at least one tag per datapoint.
+		tags["source"] = "prometheus"
+	}
+	return metricName, tags
+}
@@ -0,0 +1,98 @@
+package opentsdb
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// telnetTransport writes metrics using OpenTSDB's telnet line protocol
+// (`put <metric> <ts> <value> tagk=tagv ...\n`) over a persistent TCP
+// connection, for deployments that only expose the telnet port. The
+// connection is dialed lazily and transparently redialed on write failure.
+type telnetTransport struct {
+	addr string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newTelnetTransport(addr string) *telnetTransport {
+	return &telnetTransport{addr: addr}
+}
+
+// send writes metrics on the persistent connection. t.mu is held for the
+// full write (including a reconnect-and-retry on failure) so concurrent
+// callers can't interleave their writes on the same net.Conn and corrupt
+// the line protocol.
+func (t *telnetTransport) send(metrics []Metric) (int, error) {
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		buf.WriteString(telnetLine(m))
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	conn, err := t.connectLocked()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := conn.Write(buf.Bytes())
+	if err != nil {
+		t.dropLocked(conn)
+		conn, err = t.connectLocked()
+		if err != nil {
+			return 0, err
+		}
+		n, err = conn.Write(buf.Bytes())
+	}
+	return n, err
+}
+
+// connectLocked returns the current connection, dialing a new one if none
+// is open yet. Callers must hold t.mu.
+func (t *telnetTransport) connectLocked() (net.Conn, error) {
+	if t.conn != nil {
+		return t.conn, nil
+	}
+	conn, err := net.Dial("tcp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	t.conn = conn
+	return conn, nil
+}
+
+// dropLocked closes and forgets conn so the next send redials. Callers
+// must hold t.mu.
+func (t *telnetTransport) dropLocked(conn net.Conn) {
+	if t.conn == conn {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
+
+func (t *telnetTransport) close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
+
+func telnetLine(m Metric) string {
+	tags := make([]string, 0, len(m.Tags))
+	for k, v := range m.Tags {
+		tags = append(tags, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(tags)
+	return fmt.Sprintf("put %s %d %v %s\n", m.Metric, m.Timestamp, m.Value, strings.Join(tags, " "))
+}